@@ -11,66 +11,153 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	flapjack "github.com/flapjack/flapjack/src/flapjack"
+
+	"github.com/sol1/flapjack-icinga2/events"
 )
 
 type ApiClient struct {
-	config  Config
-	redis   flapjack.Transport
+	config Config
+	redis  flapjack.Transport
+
+	// batchRedis pipelines writeLoop's batches through one MULTI/EXEC round
+	// trip instead of one SendVersionQueue call per event. Optional -- nil
+	// if it couldn't be dialled, in which case sendBatch falls back to
+	// ac.redis.SendVersionQueue per event.
+	batchRedis *redisPipeline
+
+	// http is the event stream's own transport, set once by Connect -- it's
+	// what Cancel operates on, so it must never be shared with the
+	// short-lived transports NewHttpClient hands out to Poll/fetchTags,
+	// which run concurrently on their own goroutines.
 	http    *http.Transport
 	request *http.Request
+	cancel  chan struct{}
+	dedup   dedup
+	queue   *eventQueue
+
+	eventCount int64     // atomic; events successfully sent to Flapjack
+	failing    int32     // atomic bool; set while the stream is erroring
+	statusAt   time.Time // when StatusLine last reset eventCount
+}
+
+// streamStableAfter is how long the event stream has to stay open and
+// delivering before a subsequent failure resets the retry backoff to its
+// initial delay -- otherwise an Icinga 2 that immediately 401s on every
+// attempt would never actually back off.
+const streamStableAfter = 30 * time.Second
+
+// Healthy reports whether the event stream is currently delivering without
+// error, for use as the systemd watchdog's liveness check.
+func (ac *ApiClient) Healthy() bool {
+	return atomic.LoadInt32(&ac.failing) == 0
+}
+
+// StatusLine summarises the current connection state for STATUS= updates,
+// e.g. "connected, 3.0 events/s, queue hwm=12 dropped=0", the rate being
+// averaged over the time since the previous call.
+func (ac *ApiClient) StatusLine() string {
+	count := atomic.SwapInt64(&ac.eventCount, 0)
+	now := time.Now()
+	rate := float64(count) / now.Sub(ac.statusAt).Seconds()
+	ac.statusAt = now
+	if !ac.Healthy() {
+		return "reconnecting"
+	}
+	return fmt.Sprintf("connected, %.1f events/s, queue hwm=%d dropped=%d", rate, ac.queue.HighWater(), ac.queue.Dropped())
 }
 
 func (ac *ApiClient) Cancel() {
 	ac.http.CancelRequest(ac.request)
+	if ac.cancel != nil {
+		close(ac.cancel)
+	}
+}
+
+// icingaURL builds a request URL against the configured Icinga 2 endpoint,
+// routing through unixSockHost when it's a unix socket.
+func (ac *ApiClient) icingaURL(path string) string {
+	// already validated in main(), at flag-parsing time
+	endpoint, _ := parseEndpoint(ac.config.IcingaServer)
+	return "https://" + endpoint.Host() + path
 }
 
 func (ac *ApiClient) NewHttpClient() *http.Client {
-	var tls_config *tls.Config
+	// Leave RootCAs nil -- which falls back to the system trust store --
+	// unless the operator opted into a narrower pool via --icinga-cert
+	// and/or --icinga-ca-system; an empty pool trusts nothing at all, which
+	// would break every publicly-or-system-CA-signed server out of the box.
+	var ca_pool *x509.CertPool
+	if ac.config.IcingaCASystem {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		ca_pool = pool
+	} else if ac.config.IcingaCertfile != "" {
+		ca_pool = x509.NewCertPool()
+	}
 
 	if ac.config.IcingaCertfile != "" {
 		// assuming self-signed server cert -- /etc/icinga2/ca.crt
-		// TODO check behaviour for using system cert store (valid public cert)
-		CA_Pool := x509.NewCertPool()
 		serverCert, err := ioutil.ReadFile(ac.config.IcingaCertfile)
 		if err != nil {
 			log.Fatalln("Could not load server certificate")
 		}
-		CA_Pool.AppendCertsFromPEM(serverCert)
+		ca_pool.AppendCertsFromPEM(serverCert)
+	}
+
+	tls_config := &tls.Config{RootCAs: ca_pool}
+
+	if ac.config.IcingaClientCert != "" || ac.config.IcingaClientKey != "" {
+		// the standard Icinga 2 API auth mechanism alongside HTTP basic
+		cert, err := tls.LoadX509KeyPair(ac.config.IcingaClientCert, ac.config.IcingaClientKey)
+		if err != nil {
+			log.Fatalln("Could not load client certificate/key:", err)
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+
+	// already validated in main(), at flag-parsing time
+	endpoint, _ := parseEndpoint(ac.config.IcingaServer)
+
+	if endpoint.Network == "tcp" {
+		if host, _, err := net.SplitHostPort(endpoint.Address); err == nil {
+			tls_config.ServerName = host
+		}
+	}
 
-		tls_config = &tls.Config{RootCAs: CA_Pool}
+	if ac.config.IcingaInsecure {
+		tls_config.InsecureSkipVerify = true
+		log.Println("Skipping verification of server TLS certificate (--icinga-insecure)")
 	}
 
-	var tr *http.Transport
-	if tls_config == nil {
-		tr = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   time.Duration(ac.config.IcingaTimeoutMS) * time.Millisecond,
-				KeepAlive: time.Duration(ac.config.IcingaKeepAliveMS) * time.Millisecond,
-			}).Dial,
-			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-			TLSHandshakeTimeout: 10 * time.Second,
+	var dial func(network, addr string) (net.Conn, error)
+	if endpoint.Network == "unix" {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", endpoint.Address)
 		}
-		log.Println("Skipping verification of server TLS certificate")
 	} else {
-		tr = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   time.Duration(ac.config.IcingaTimeoutMS) * time.Millisecond,
-				KeepAlive: time.Duration(ac.config.IcingaKeepAliveMS) * time.Millisecond,
-			}).Dial,
-			TLSClientConfig:     tls_config,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
+		dial = (&net.Dialer{
+			Timeout:   time.Duration(ac.config.IcingaTimeoutMS) * time.Millisecond,
+			KeepAlive: time.Duration(ac.config.IcingaKeepAliveMS) * time.Millisecond,
+		}).Dial
 	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dial,
+		TLSClientConfig:     tls_config,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
 	client := &http.Client{
 		Transport: tr,
 	}
 
-	ac.http = tr
 	return client
 }
 
@@ -81,46 +168,88 @@ func (ac *ApiClient) NewHttpRequest(method string, url string) *http.Request {
 	return req
 }
 
-func (ac *ApiClient) Connect(finished chan<- error) {
-	icinga_url_parts := []string{
-		"https://", ac.config.IcingaServer, "/v1/events?queue=", ac.config.IcingaQueue,
-		"&types=CheckResult&types=StateChange",
-	}
-	var icinga_url bytes.Buffer
-	for i := range icinga_url_parts {
-		icinga_url.WriteString(icinga_url_parts[i])
+// Connect opens the Icinga 2 event stream and feeds decoded events to Redis
+// until it fails or is cancelled. ready is signalled once, after the first
+// HTTP 200 response, so callers can use it as an systemd READY=1 trigger;
+// finished receives the terminal error (nil on a clean cancellation).
+func (ac *ApiClient) Connect(finished chan<- error, ready chan<- struct{}) {
+	var path bytes.Buffer
+	path.WriteString("/v1/events?queue=")
+	path.WriteString(ac.config.IcingaQueue)
+	for _, t := range ac.config.IcingaTypes {
+		path.WriteString("&types=")
+		path.WriteString(t)
 	}
+	icinga_url := ac.icingaURL(path.String())
 
 	client := ac.NewHttpClient()
-	req := ac.NewHttpRequest("POST", icinga_url.String())
+	ac.http, _ = client.Transport.(*http.Transport)
+
+	req := ac.NewHttpRequest("POST", icinga_url)
 
 	ac.request = req
+	ac.cancel = make(chan struct{})
+	ac.statusAt = time.Now()
 
 	go func() {
 		done := false
+		notified := false
+		attempt := 0
+		var retryElapsed time.Duration
 
 		for done == false {
+			streamOpened := time.Time{}
+
 			resp, err := client.Do(req)
 			if err == nil {
 				if ac.config.Debug {
-					fmt.Printf("URL: %+v\n", icinga_url.String())
+					fmt.Printf("URL: %+v\n", icinga_url)
 					fmt.Printf("Response: %+v\n", resp.Status)
 				}
 
 				if resp.StatusCode == http.StatusOK {
+					atomic.StoreInt32(&ac.failing, 0)
+					if !notified {
+						notified = true
+						ready <- struct{}{}
+					}
+					streamOpened = time.Now()
 					err = ac.processResponse(resp)
 				} else {
-					defer func() {
-						resp.Body.Close()
-					}()
 					body, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
 					err = fmt.Errorf("API HTTP request failed: %s , %s", resp.Status, body)
 				}
 			}
 
-			if err != nil {
-				finished <- err
+			if err == nil {
+				continue
+			}
+
+			atomic.StoreInt32(&ac.failing, 1)
+
+			if !streamOpened.IsZero() && time.Since(streamOpened) >= streamStableAfter {
+				attempt = 0
+				retryElapsed = 0
+			}
+
+			delay := computeBackoff(attempt, ac.config.RetryInitial, ac.config.RetryMax, ac.config.RetryJitter)
+			retryElapsed += delay
+
+			if ac.config.RetryTimeout > 0 && retryElapsed > ac.config.RetryTimeout {
+				finished <- fmt.Errorf("giving up after %s of retrying: %s", retryElapsed, err)
+				done = true
+				continue
+			}
+
+			log.Printf("stream error, retrying in %s (attempt=%d): %s", delay, attempt, err)
+			attempt++
+
+			select {
+			case <-ac.cancel:
+				finished <- nil
 				done = true
+			case <-time.After(delay):
 			}
 		}
 	}()
@@ -139,101 +268,63 @@ func (ac *ApiClient) processResponse(resp *http.Response) error {
 
 	for decoder.More() {
 
-		var data interface{}
+		var raw json.RawMessage
 
-		err := decoder.Decode(&data)
+		err := decoder.Decode(&raw)
 
 		if err != nil {
 			return err
 		}
 
-		m := data.(map[string]interface{})
-
 		if ac.config.Debug {
-			fmt.Printf("Decoded Response: %+v\n", data)
+			fmt.Printf("Decoded Response: %s\n", raw)
 		}
 
-		switch m["type"] {
-		case "CheckResult", "StateChange":
-			check_result := m["check_result"].(map[string]interface{})
-			timestamp := m["timestamp"].(float64)
-
-			// https://github.com/Icinga/icinga2/blob/master/lib/icinga/checkresult.ti#L37-L48
-			var state string
-
-			switch check_result["state"].(float64) {
-			case 0.0:
-				state = "ok"
-			case 1.0:
-				state = "warning"
-			case 2.0:
-				state = "critical"
-			case 3.0:
-				state = "unknown"
-			default:
-			}
-
-			if state == "" {
-				return fmt.Errorf("Unknown state %.1f", check_result["state"].(float64))
-			}
-
-			// build and submit Flapjack redis event
-			var varURL string
-			var service string
-			var serviceType string
-			var name string
-
-			if serv, ok := m["service"]; ok {
-				service = serv.(string)
-				serviceType = "services"
-				name = fmt.Sprintf("%s!%s", m["host"], m["service"])
-			} else {
-				service = "HOST"
-				serviceType = "hosts"
-				name = m["host"].(string)
-			}
-
-			varURL = fmt.Sprintf("https://%s/v1/objects/%s/%s", ac.config.IcingaServer, serviceType, name)
+		var env events.Envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return err
+		}
 
-			client := ac.NewHttpClient()
-			req := ac.NewHttpRequest("GET", varURL)
+		var event *flapjack.Event
 
-			resp, _ = client.Do(req)
-			decoder = json.NewDecoder(resp.Body)
-			err = decoder.Decode(&data)
-			if err != nil {
+		switch env.Type {
+		case "CheckResult", "StateChange":
+			var e events.CheckResultEvent
+			if err := json.Unmarshal(raw, &e); err != nil {
 				return err
 			}
-
-			extra := data.(map[string]interface{})
-			result := extra["results"].([]interface{})
-			first := result[0].(map[string]interface{})
-			attrs := first["attrs"].(map[string]interface{})
-			vars := attrs["vars"].(map[string]interface{})
-
-			var tags []string
-			if val, ok := vars["tags"]; ok {
-				tags = val.([]string)
+			event, err = ac.checkResultToEvent(e)
+		case "CommentAdded", "CommentRemoved":
+			var e events.CommentEvent
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return err
 			}
-
-			event := flapjack.Event{
-				Entity:  m["host"].(string),
-				Check:   service,
-				Type:    "service",
-				Time:    int64(timestamp),
-				State:   state,
-				Summary: check_result["output"].(string),
-				Details: fmt.Sprintf("tags: %s", tags),
-				Tags:    tags,
+			event = commentToEvent(e)
+		case "AcknowledgementSet", "AcknowledgementCleared":
+			var e events.AcknowledgementEvent
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return err
 			}
-
-			// TODO handle err better -- e.g. redis down?
-			_, err := ac.redis.SendVersionQueue(event, ac.config.FlapjackVersion, ac.config.FlapjackEvents)
-			if err != nil {
+			event = acknowledgementToEvent(e)
+		case "DowntimeAdded", "DowntimeRemoved", "DowntimeStarted", "DowntimeTriggered":
+			var e events.DowntimeEvent
+			if err := json.Unmarshal(raw, &e); err != nil {
 				return err
 			}
+			event, err = ac.downtimeToEvent(e)
 		default:
-			return fmt.Errorf("Unknown type %s", m["type"])
+			return fmt.Errorf("Unknown type %s", env.Type)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// hand off to the writer goroutine so a slow Redis doesn't stall
+		// the decoder on every event's round-trip
+		ac.queue.Push(*event)
+		if ac.config.PollInterval > 0 {
+			ac.markSent(event.Entity + "!" + event.Check)
 		}
 	}
 	return nil
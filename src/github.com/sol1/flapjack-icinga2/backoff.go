@@ -0,0 +1,21 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// computeBackoff returns the delay before the given retry attempt (0-based):
+// initial*2^attempt, capped at max, plus up to jitter of random delay.
+func computeBackoff(attempt int, initial, max, jitter time.Duration) time.Duration {
+	delay := initial << uint(attempt)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	return delay
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// unixSockHost is the placeholder Host used to build request URLs when
+// talking to a unix socket -- it never hits the wire, since the Transport's
+// Dial func ignores the address http.Client derives it from and dials the
+// socket path instead.
+const unixSockHost = "unix.sock"
+
+// Endpoint is a parsed --icinga/--redis value: either a TCP host:port or a
+// unix domain socket path.
+type Endpoint struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port for tcp, socket path for unix
+}
+
+// Host is what to put in the Host portion of a request URL built against
+// this endpoint.
+func (e Endpoint) Host() string {
+	if e.Network == "unix" {
+		return unixSockHost
+	}
+	return e.Address
+}
+
+// parseEndpoint accepts `host:port`, `scheme://host:port`, and
+// `unix:///path/to.sock`, and reports an error for anything else -- in
+// particular it no longer assumes every value splits into exactly two
+// `strings.Split(..., ":")` parts, which broke on scheme:// and unix://
+// values alike.
+func parseEndpoint(raw string) (Endpoint, error) {
+	if strings.HasPrefix(raw, "unix://") {
+		path := strings.TrimPrefix(raw, "unix://")
+		if path == "" {
+			return Endpoint{}, fmt.Errorf("unix:// endpoint requires a socket path")
+		}
+		return Endpoint{Network: "unix", Address: path}, nil
+	}
+
+	withScheme := raw
+	if !strings.Contains(raw, "://") {
+		withScheme = "tcp://" + raw
+	}
+
+	u, err := url.Parse(withScheme)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return Endpoint{}, fmt.Errorf("%q is missing a host:port", raw)
+	}
+
+	return Endpoint{Network: "tcp", Address: u.Host}, nil
+}
+
+// redisDialURL normalises a --redis value into the URL form FlapjackDial's
+// underlying redis.DialURL expects, preserving a unix:// socket path rather
+// than handing it the raw flag value -- redis.DialURL doesn't otherwise know
+// a bare unix:///path isn't a host:port.
+func redisDialURL(raw string) (string, error) {
+	endpoint, err := parseEndpoint(raw)
+	if err != nil {
+		return "", err
+	}
+	if endpoint.Network == "unix" {
+		return "unix://" + endpoint.Address, nil
+	}
+	return "redis://" + endpoint.Address, nil
+}
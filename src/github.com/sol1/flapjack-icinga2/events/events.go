@@ -0,0 +1,105 @@
+// Package events defines the Icinga 2 event-stream payloads this bridge
+// understands, with JSON tags matching the wire format documented at
+// https://icinga.com/docs/icinga-2/latest/doc/12-icinga2-api/#event-streams
+package events
+
+// Envelope holds the fields common to every event-stream message; embed it
+// in a type-specific struct to decode the rest of the payload.
+type Envelope struct {
+	Type      string  `json:"type"`
+	Timestamp float64 `json:"timestamp"`
+	Host      string  `json:"host"`
+	Service   string  `json:"service,omitempty"`
+}
+
+// CheckResult is the result of a single check execution, carried by both
+// CheckResult and StateChange events.
+type CheckResult struct {
+	State         float64 `json:"state"`
+	Output        string  `json:"output"`
+	CheckSource   string  `json:"check_source"`
+	ScheduleStart float64 `json:"schedule_start"`
+	ScheduleEnd   float64 `json:"schedule_end"`
+}
+
+type CheckResultEvent struct {
+	Envelope
+	CheckResult CheckResult `json:"check_result"`
+}
+
+type StateChangeEvent struct {
+	Envelope
+	CheckResult CheckResult `json:"check_result"`
+	State       float64     `json:"state"`
+	StateType   float64     `json:"state_type"`
+}
+
+// Comment is the object added or removed by the CommentAdded/CommentRemoved
+// events.
+type Comment struct {
+	Author     string  `json:"author"`
+	Text       string  `json:"text"`
+	EntryTime  float64 `json:"entry_time"`
+	EntryType  float64 `json:"entry_type"`
+	ExpireTime float64 `json:"expire_time"`
+}
+
+type CommentEvent struct {
+	Envelope
+	Comment Comment `json:"comment"`
+}
+
+// AcknowledgementEvent covers both AcknowledgementSet and
+// AcknowledgementCleared -- Comment/Expiry/AcknowledgementType are absent on
+// AcknowledgementCleared.
+type AcknowledgementEvent struct {
+	Envelope
+	State               float64 `json:"state"`
+	StateType           float64 `json:"state_type"`
+	Author              string  `json:"author"`
+	Comment             string  `json:"comment"`
+	AcknowledgementType float64 `json:"acknowledgement_type"`
+	Notify              bool    `json:"notify"`
+	Expiry              float64 `json:"expiry"`
+}
+
+// Downtime is the scheduled downtime object carried by the
+// DowntimeAdded/DowntimeRemoved/DowntimeStarted/DowntimeTriggered events.
+type Downtime struct {
+	Author    string  `json:"author"`
+	Comment   string  `json:"comment"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Duration  float64 `json:"duration"`
+	Fixed     bool    `json:"fixed"`
+}
+
+type DowntimeEvent struct {
+	Envelope
+	Downtime Downtime `json:"downtime"`
+}
+
+// ObjectsResponse is the body of a GET against /v1/objects/hosts or
+// /v1/objects/services, used by the polling mode to pull full status
+// without waiting on the event stream.
+type ObjectsResponse struct {
+	Results []ObjectResult `json:"results"`
+}
+
+type ObjectResult struct {
+	Name  string      `json:"name"`
+	Attrs ObjectAttrs `json:"attrs"`
+}
+
+type ObjectAttrs struct {
+	Name            string      `json:"name"`
+	HostName        string      `json:"host_name,omitempty"`
+	State           float64     `json:"state"`
+	LastCheckResult CheckResult `json:"last_check_result"`
+	LastCheck       float64     `json:"last_check"`
+	Acknowledgement float64     `json:"acknowledgement"`
+	DowntimeDepth   float64     `json:"downtime_depth"`
+	Vars            struct {
+		Tags []string `json:"tags"`
+	} `json:"vars"`
+}
@@ -1,4 +1,4 @@
-package flapjack_icinga2
+package main
 
 // TODO clean up, split into multiple files
 
@@ -7,16 +7,15 @@ package flapjack_icinga2
 // NB: all completely WIP, not running yet
 
 import (
-  "bytes"
 	"fmt"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-  "syscall"
+	"syscall"
+	"time"
+
+	flapjack "github.com/flapjack/flapjack/src/flapjack"
 )
 
 var (
@@ -24,6 +23,17 @@ var (
 
 	icinga_server = app.Flag("icinga", "Icinga 2 API endpoint to connect to (default localhost:5665)").Default("localhost:5665").String()
 	icinga_queue  = app.Flag("queue", "Icinga 2 event queue name to use (default flapjack)").Default("flapjack").String()
+	icinga_types  = app.Flag("types", "Icinga 2 event type to subscribe to (repeatable)").Default("CheckResult", "StateChange", "CommentAdded", "CommentRemoved").Strings()
+
+	icinga_user         = app.Flag("icinga-user", "Icinga 2 API user for HTTP basic auth").String()
+	icinga_password     = app.Flag("icinga-password", "Icinga 2 API password for HTTP basic auth").String()
+	icinga_certfile     = app.Flag("icinga-cert", "Path to Icinga 2 API server CA certificate (PEM)").String()
+	icinga_client_cert  = app.Flag("icinga-client-cert", "Path to a client certificate (PEM) to authenticate to the Icinga 2 API").String()
+	icinga_client_key   = app.Flag("icinga-client-key", "Path to the private key (PEM) for --icinga-client-cert").String()
+	icinga_ca_system    = app.Flag("icinga-ca-system", "Also trust the system CA pool, alongside --icinga-cert (default false)").Bool()
+	icinga_insecure     = app.Flag("icinga-insecure", "Skip verification of the Icinga 2 API server's TLS certificate (default false)").Bool()
+	icinga_timeout_ms   = app.Flag("icinga-timeout-ms", "Dial timeout for the Icinga 2 API connection, in milliseconds (default 5000)").Default("5000").Int()
+	icinga_keepalive_ms = app.Flag("icinga-keepalive-ms", "TCP keepalive interval for the Icinga 2 API connection, in milliseconds (default 30000)").Default("30000").Int()
 
 	// default Redis port is 6380 rather than 6379 as the Flapjack packages ship
 	// with an Omnibus-packaged Redis running on a different port to the
@@ -31,15 +41,51 @@ var (
 	redis_server   = app.Flag("redis", "Redis server to connect to (default localhost:6380)").Default("localhost:6380").String()
 	redis_database = app.Flag("db", "Redis database to connect to (default 0)").Int()
 
+	flapjack_version = app.Flag("flapjack-version", "Flapjack event API version to submit (default 1)").Default("1").String()
+	flapjack_events  = app.Flag("flapjack-events-queue", "Redis queue name used for Flapjack events (default events)").Default("events").String()
+
+	retry_initial = app.Flag("retry-initial", "Initial delay before reconnecting after a stream error (default 1s)").Default("1s").Duration()
+	retry_max     = app.Flag("retry-max", "Maximum delay between reconnection attempts (default 60s)").Default("60s").Duration()
+	retry_timeout = app.Flag("retry-timeout", "Give up and exit non-zero after this much cumulative retry time (default 0, retry forever)").Default("0").Duration()
+	retry_jitter  = app.Flag("retry-jitter", "Random jitter added to each retry delay, up to this duration (default 0)").Default("0").Duration()
+
+	poll_interval = app.Flag("poll-interval", "Also poll full host/service status at this interval (default 0, disabled)").Default("0").Duration()
+
+	queue_depth    = app.Flag("queue-depth", "Size of the in-memory queue between the decoder and the Redis writer (default 1024)").Default("1024").Int()
+	batch_size     = app.Flag("batch-size", "Flush the Redis writer after this many queued events (default 100)").Default("100").Int()
+	batch_interval = app.Flag("batch-interval", "Flush the Redis writer after this much time, even if the batch isn't full (default 200ms)").Default("200ms").Duration()
+	overflow       = app.Flag("overflow", "Policy when the queue is full: block or drop-oldest (default block)").Default("block").Enum("block", "drop-oldest")
+
 	debug = app.Flag("debug", "Enable verbose output (default false)").Bool()
 )
 
 type Config struct {
-	IcingaServer  string
-	IcingaQueue   string
-	RedisServer   string
-	RedisDatabase int
-	Debug         bool
+	IcingaServer      string
+	IcingaQueue       string
+	IcingaTypes       []string
+	IcingaUser        string
+	IcingaPassword    string
+	IcingaCertfile    string
+	IcingaClientCert  string
+	IcingaClientKey   string
+	IcingaCASystem    bool
+	IcingaInsecure    bool
+	IcingaTimeoutMS   int
+	IcingaKeepAliveMS int
+	RedisServer       string
+	RedisDatabase     int
+	FlapjackVersion   string
+	FlapjackEvents    string
+	RetryInitial      time.Duration
+	RetryMax          time.Duration
+	RetryTimeout      time.Duration
+	RetryJitter       time.Duration
+	PollInterval      time.Duration
+	QueueDepth        int
+	BatchSize         int
+	BatchInterval     time.Duration
+	Overflow          string
+	Debug             bool
 }
 
 func main() {
@@ -48,96 +94,133 @@ func main() {
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	app.Writer(os.Stderr) // ... but ensure errors go to stderr
 
-	icinga_addr := strings.Split(*icinga_server, ":")
-	if len(icinga_addr) != 2 {
-		fmt.Println("Error: invalid icinga_server specified:", *icinga_server)
-		fmt.Println("Should be in format `host:port` (e.g. 127.0.0.1:5665)")
+	if _, err := parseEndpoint(*icinga_server); err != nil {
+		fmt.Println("Error: invalid icinga_server specified:", *icinga_server, "-", err)
+		fmt.Println("Should be `host:port`, `scheme://host:port`, or `unix:///path/to.sock`")
 		os.Exit(1)
 	}
 
-	redis_addr := strings.Split(*redis_server, ":")
-	if len(redis_addr) != 2 {
-		fmt.Println("Error: invalid redis_server specified:", *redis_server)
-		fmt.Println("Should be in format `host:port` (e.g. 127.0.0.1:6380)")
+	if _, err := parseEndpoint(*redis_server); err != nil {
+		fmt.Println("Error: invalid redis_server specified:", *redis_server, "-", err)
+		fmt.Println("Should be `host:port`, `scheme://host:port`, or `unix:///path/to.sock`")
 		os.Exit(1)
 	}
 
 	config := Config{
-		IcingaServer:  *icinga_server,
-		IcingaQueue:   *icinga_queue,
-		RedisServer:   *redis_server,
-		RedisDatabase: *redis_database,
-		Debug:         *debug,
+		IcingaServer:      *icinga_server,
+		IcingaQueue:       *icinga_queue,
+		IcingaTypes:       *icinga_types,
+		IcingaUser:        *icinga_user,
+		IcingaPassword:    *icinga_password,
+		IcingaCertfile:    *icinga_certfile,
+		IcingaClientCert:  *icinga_client_cert,
+		IcingaClientKey:   *icinga_client_key,
+		IcingaCASystem:    *icinga_ca_system,
+		IcingaInsecure:    *icinga_insecure,
+		IcingaTimeoutMS:   *icinga_timeout_ms,
+		IcingaKeepAliveMS: *icinga_keepalive_ms,
+		RedisServer:       *redis_server,
+		RedisDatabase:     *redis_database,
+		FlapjackVersion:   *flapjack_version,
+		FlapjackEvents:    *flapjack_events,
+		RetryInitial:      *retry_initial,
+		RetryMax:          *retry_max,
+		RetryTimeout:      *retry_timeout,
+		RetryJitter:       *retry_jitter,
+		PollInterval:      *poll_interval,
+		QueueDepth:        *queue_depth,
+		BatchSize:         *batch_size,
+		BatchInterval:     *batch_interval,
+		Overflow:          *overflow,
+		Debug:             *debug,
 	}
 
 	if config.Debug {
 		log.Printf("Booting with config: %+v\n", config)
 	}
 
-	// shutdown signal handler
-	sigs := make(chan os.Signal, 1)
-	done := false
-
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-  icinga_url_parts := []string{
-    "http://", config.IcingaServer, "events?queue=", config.IcingaQueue,
-    "&types=CheckResult&types=StateChange&types=CommentAdded&types=CommentRemoved",
-  }
-  var icinga_url bytes.Buffer
-  for i := range icinga_url_parts {
-    icinga_url.WriteString(icinga_url_parts[i])
-  }
-
-  transport, err := FlapjackDial(config.RedisServer, config.RedisDatabase)
-  if err != nil {
-    fmt.Println("Couldn't establish Redis connection: %s", err)
-    os.Exit(1)
-  }
-
-	req, _ := http.NewRequest("GET", icinga_url.String(), nil)
-	tr := &http.Transport{} // TODO settings from DefaultTransport
-	client := &http.Client{Transport: tr}
-	c := make(chan error, 1)
+	redisURL, err := redisDialURL(config.RedisServer)
+	if err != nil {
+		fmt.Println("Error: invalid redis_server specified:", config.RedisServer, "-", err)
+		os.Exit(1)
+	}
 
-	for done == false {
+	transport, err := flapjack.FlapjackDial(redisURL, config.RedisDatabase)
+	if err != nil {
+		fmt.Printf("Couldn't establish Redis connection: %s\n", err)
+		os.Exit(1)
+	}
+	// Redis is up from here on, which is half of what systemd needs to know
+	// before we can report READY=1 -- the other half is the Icinga 2 stream
+	// below.
+
+	// batchRedis is a second, dedicated connection used only to pipeline
+	// writeLoop's batches; it's optional -- if it can't be dialled,
+	// sendBatch just falls back to one SendVersionQueue call per event.
+	var batchRedis *redisPipeline
+	if redisEndpoint, err := parseEndpoint(config.RedisServer); err == nil {
+		batchRedis, err = newRedisPipeline(redisEndpoint, config.RedisDatabase)
+		if err != nil {
+			log.Printf("Couldn't establish a pipelined Redis connection, falling back to per-event sends: %s", err)
+		}
+	}
 
-		go func() {
-			resp, h_err := client.Do(req)
+	ac := &ApiClient{
+		config:     config,
+		redis:      transport,
+		batchRedis: batchRedis,
+		queue:      newEventQueue(config.QueueDepth, config.Overflow),
+	}
 
-			if h_err == nil {
-				defer resp.Body.Close()
-				contents, e := ioutil.ReadAll(resp.Body)
-				if e != nil {
-					fmt.Printf("%s", e)
-				} else {
-					fmt.Printf("%s\n", string(contents))
+	stopWriter := make(chan struct{})
+	go ac.writeLoop(stopWriter)
 
-          // TODO decode JSON response to object
+	// shutdown signal handler
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-          // TODO build and submit Flapjack redis event, if event type is relevant
-          event := FlapjackEvent{}
+	finished := make(chan error, 1)
+	ready := make(chan struct{}, 1)
+	ac.Connect(finished, ready)
 
-          // _, er
-          _, _ = transport.Send(event)
+	stopWatchdog := make(chan struct{})
+	go func() {
+		select {
+		case <-ready:
+			sdNotifyReady()
+			go sdWatchdogLoop(ac.Healthy, ac.StatusLine, stopWatchdog)
+		case <-stopWatchdog:
+		}
+	}()
 
-				}
-			}
+	stopPoll := make(chan struct{})
+	if config.PollInterval > 0 {
+		go ac.Poll(stopPoll)
+	}
 
-			c <- h_err
-		}()
+	var exitErr error
+
+	select {
+	case <-sigs:
+		log.Println("Cancelling request")
+		sdNotifyStopping()
+		close(stopWatchdog)
+		close(stopPoll)
+		ac.Cancel()
+		<-finished
+		close(stopWriter)
+	case err := <-finished:
+		log.Println("Client finished:", err)
+		exitErr = err
+	}
 
-		select {
-		case <-sigs:
-			log.Println("Cancelling request")
-			tr.CancelRequest(req)
-			done = true
-		case err := <-c:
-      _ = err
-			// log.Println("Client finished:", err)
-		}
+	// close redis connection(s)
+	transport.Close()
+	if batchRedis != nil {
+		batchRedis.Close()
 	}
 
-  // close redis connection
-  transport.Close()
-}
\ No newline at end of file
+	if exitErr != nil {
+		os.Exit(1)
+	}
+}
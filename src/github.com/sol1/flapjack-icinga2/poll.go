@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	flapjack "github.com/flapjack/flapjack/src/flapjack"
+
+	"github.com/sol1/flapjack-icinga2/events"
+)
+
+// Poll runs until stop is closed, pulling full host/service status from the
+// Icinga 2 API every PollInterval and emitting one Flapjack event per
+// object. It complements the event stream for bootstrapping Flapjack after
+// a restart (before any state-change event has flowed) and for deployments
+// where the stream itself is unreliable.
+func (ac *ApiClient) Poll(stop <-chan struct{}) {
+	ticker := time.NewTicker(ac.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ac.pollObjects("hosts"); err != nil {
+				log.Printf("poll of hosts failed: %s", err)
+			}
+			if err := ac.pollObjects("services"); err != nil {
+				log.Printf("poll of services failed: %s", err)
+			}
+		}
+	}
+}
+
+// pollObjects fetches every host or service object in one request (via
+// attrs/joins, rather than processResponse's per-event follow-up GET) and
+// emits a Flapjack event for each one not recently seen via the stream.
+func (ac *ApiClient) pollObjects(objectType string) error {
+	path := fmt.Sprintf(
+		"/v1/objects/%s?attrs=name&attrs=state&attrs=last_check_result&attrs=last_check&attrs=acknowledgement&attrs=downtime_depth&attrs=vars",
+		objectType,
+	)
+	if objectType == "services" {
+		path += "&attrs=host_name&joins=host.display_name"
+	}
+	url := ac.icingaURL(path)
+
+	client := ac.NewHttpClient()
+	req := ac.NewHttpRequest("GET", url)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var parsed events.ObjectsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return err
+	}
+
+	for _, result := range parsed.Results {
+		host := result.Attrs.HostName
+		service := result.Attrs.Name
+		if objectType == "hosts" {
+			host = result.Attrs.Name
+			service = ""
+		} else if idx := strings.LastIndex(service, "!"); idx >= 0 {
+			// a Service object's own `name` attr is the full "host!service"
+			// identifier, not the short check name -- host_name is fetched
+			// separately above precisely because of this split
+			service = service[idx+1:]
+		}
+
+		entity, check := entityCheck(host, service)
+
+		if !ac.shouldEmit(entity + "!" + check) {
+			continue
+		}
+
+		state, err := stateName(result.Attrs.State)
+		if err != nil {
+			return err
+		}
+
+		event := flapjack.Event{
+			Entity:  entity,
+			Check:   check,
+			Type:    "service",
+			Time:    int64(result.Attrs.LastCheck),
+			State:   state,
+			Summary: result.Attrs.LastCheckResult.Output,
+			Details: fmt.Sprintf("tags: %s, acknowledgement: %.0f, downtime_depth: %.0f",
+				result.Attrs.Vars.Tags, result.Attrs.Acknowledgement, result.Attrs.DowntimeDepth),
+			Tags: result.Attrs.Vars.Tags,
+		}
+
+		ac.queue.Push(event)
+	}
+
+	return nil
+}
+
+// dedup tracks the last time an entity!check was sent, whether via the
+// stream or a poll, so the two don't emit redundant events for the same
+// check within a single PollInterval window.
+type dedup struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// shouldEmit reports whether key hasn't been sent within the last
+// PollInterval, and if so records it as sent now.
+func (ac *ApiClient) shouldEmit(key string) bool {
+	ac.dedup.mu.Lock()
+	defer ac.dedup.mu.Unlock()
+
+	if ac.dedup.sent == nil {
+		ac.dedup.sent = make(map[string]time.Time)
+	}
+
+	if last, ok := ac.dedup.sent[key]; ok && time.Since(last) < ac.config.PollInterval {
+		return false
+	}
+
+	ac.dedup.sent[key] = time.Now()
+	return true
+}
+
+// markSent records key as sent now, without the shouldEmit check -- used by
+// the event stream, which should never be suppressed by the poller.
+func (ac *ApiClient) markSent(key string) {
+	ac.dedup.mu.Lock()
+	defer ac.dedup.mu.Unlock()
+
+	if ac.dedup.sent == nil {
+		ac.dedup.sent = make(map[string]time.Time)
+	}
+	ac.dedup.sent[key] = time.Now()
+}
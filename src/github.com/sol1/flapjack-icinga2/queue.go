@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	flapjack "github.com/flapjack/flapjack/src/flapjack"
+)
+
+// eventQueue buffers decoded events between processResponse's decoder
+// goroutine and the Redis writer goroutine, so a slow or stalled Redis
+// doesn't stall the decoder on every event's round-trip.
+type eventQueue struct {
+	ch        chan flapjack.Event
+	policy    string // "block" or "drop-oldest"
+	highWater int64  // atomic
+	dropped   int64  // atomic
+}
+
+func newEventQueue(depth int, policy string) *eventQueue {
+	return &eventQueue{
+		ch:     make(chan flapjack.Event, depth),
+		policy: policy,
+	}
+}
+
+// Push enqueues an event, applying the configured overflow policy when the
+// queue is full: "block" (the default) makes the caller -- the decoder --
+// wait for room; "drop-oldest" discards the oldest queued event instead.
+func (q *eventQueue) Push(e flapjack.Event) {
+	if q.policy == "drop-oldest" {
+		select {
+		case q.ch <- e:
+		default:
+			select {
+			case <-q.ch:
+				atomic.AddInt64(&q.dropped, 1)
+			default:
+			}
+			q.ch <- e
+		}
+	} else {
+		q.ch <- e
+	}
+
+	q.recordDepth()
+}
+
+func (q *eventQueue) recordDepth() {
+	depth := int64(len(q.ch))
+	for {
+		hw := atomic.LoadInt64(&q.highWater)
+		if depth <= hw || atomic.CompareAndSwapInt64(&q.highWater, hw, depth) {
+			return
+		}
+	}
+}
+
+func (q *eventQueue) HighWater() int64 { return atomic.LoadInt64(&q.highWater) }
+func (q *eventQueue) Dropped() int64   { return atomic.LoadInt64(&q.dropped) }
+
+// writeLoop drains ac.queue into Redis in batches, flushing whenever the
+// batch reaches BatchSize events or BatchInterval elapses, whichever comes
+// first. It returns once stop is closed and the queue has been drained.
+func (ac *ApiClient) writeLoop(stop <-chan struct{}) {
+	batch := make([]flapjack.Event, 0, ac.config.BatchSize)
+
+	ticker := time.NewTicker(ac.config.BatchInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ac.sendBatch(batch); err != nil {
+			log.Printf("batch send to Redis failed: %s", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e := <-ac.queue.ch:
+			batch = append(batch, e)
+			if len(batch) >= ac.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			// stop is now permanently ready, so don't let select's random
+			// choice between it and ac.queue.ch drop whatever's still
+			// queued -- drain it explicitly before flushing and returning.
+			for {
+				select {
+				case e := <-ac.queue.ch:
+					batch = append(batch, e)
+					if len(batch) >= ac.config.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendBatch submits a batch of events to Redis, pipelining them in one
+// MULTI/EXEC round trip via ac.batchRedis when it's available, and falling
+// back to one SendVersionQueue call per event otherwise.
+func (ac *ApiClient) sendBatch(batch []flapjack.Event) error {
+	if ac.batchRedis != nil {
+		if _, err := ac.batchRedis.SendBatch(batch, ac.config.FlapjackVersion, ac.config.FlapjackEvents); err != nil {
+			return fmt.Errorf("sending batch of %d: %s", len(batch), err)
+		}
+		atomic.AddInt64(&ac.eventCount, int64(len(batch)))
+		return nil
+	}
+
+	for _, event := range batch {
+		if _, err := ac.redis.SendVersionQueue(event, ac.config.FlapjackVersion, ac.config.FlapjackEvents); err != nil {
+			return fmt.Errorf("sending %s!%s: %s", event.Entity, event.Check, err)
+		}
+		atomic.AddInt64(&ac.eventCount, 1)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+
+	flapjack "github.com/flapjack/flapjack/src/flapjack"
+)
+
+// redisPipeline is a thin wrapper around its own Redis connection, used only
+// to submit a whole batch of events in one MULTI/EXEC round trip --
+// flapjack.Transport only exposes SendVersionQueue one event at a time.
+type redisPipeline struct {
+	conn redis.Conn
+}
+
+// newRedisPipeline dials a connection to the same Redis endpoint/database as
+// ac.redis, for the sole purpose of batch submission.
+func newRedisPipeline(endpoint Endpoint, database int) (*redisPipeline, error) {
+	conn, err := redis.Dial(endpoint.Network, endpoint.Address)
+	if err != nil {
+		return nil, err
+	}
+	if database != 0 {
+		if _, err := conn.Do("SELECT", database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &redisPipeline{conn: conn}, nil
+}
+
+// pipelinedEvent is the wire shape flapjack.Transport.SendVersionQueue pushes
+// for a single event -- mirrored here so a whole batch can be RPUSHed in one
+// MULTI/EXEC instead of one round trip per event.
+type pipelinedEvent struct {
+	Entity  string   `json:"entity"`
+	Check   string   `json:"check"`
+	Type    string   `json:"type"`
+	State   string   `json:"state"`
+	Summary string   `json:"summary"`
+	Details string   `json:"details"`
+	Tags    []string `json:"tags,omitempty"`
+	Time    int64    `json:"time"`
+	Version string   `json:"version"`
+}
+
+// SendBatch pushes every event onto queueName in a single MULTI/EXEC round
+// trip.
+func (p *redisPipeline) SendBatch(events []flapjack.Event, version, queueName string) (interface{}, error) {
+	p.conn.Send("MULTI")
+	for _, event := range events {
+		body, err := json.Marshal(pipelinedEvent{
+			Entity:  event.Entity,
+			Check:   event.Check,
+			Type:    event.Type,
+			State:   event.State,
+			Summary: event.Summary,
+			Details: event.Details,
+			Tags:    event.Tags,
+			Time:    event.Time,
+			Version: version,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.conn.Send("RPUSH", queueName, body)
+	}
+	return p.conn.Do("EXEC")
+}
+
+func (p *redisPipeline) Close() error {
+	return p.conn.Close()
+}
+
+// scheduledMaintenance is the JSON member stored in a check's
+// "<entity>:<check>:scheduled_maintenances" sorted set, scored by start
+// time -- the same redis-side representation Flapjack itself reads
+// scheduled downtime windows from.
+type scheduledMaintenance struct {
+	StartTime float64 `json:"start_time"`
+	Duration  float64 `json:"duration"`
+	Summary   string  `json:"summary"`
+}
+
+func scheduledMaintenanceKey(entity, check string) string {
+	return fmt.Sprintf("%s:%s:scheduled_maintenances", entity, check)
+}
+
+// PushScheduledMaintenance records a new downtime window for entity!check.
+func (p *redisPipeline) PushScheduledMaintenance(entity, check string, m scheduledMaintenance) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Do("ZADD", scheduledMaintenanceKey(entity, check), m.StartTime, body)
+	return err
+}
+
+// RemoveScheduledMaintenance drops the downtime window starting at startTime
+// for entity!check.
+func (p *redisPipeline) RemoveScheduledMaintenance(entity, check string, startTime float64) error {
+	_, err := p.conn.Do("ZREMRANGEBYSCORE", scheduledMaintenanceKey(entity, check), startTime, startTime)
+	return err
+}
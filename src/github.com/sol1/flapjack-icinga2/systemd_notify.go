@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// sdNotifyReady and sdNotifyStopping are no-ops when NOTIFY_SOCKET is unset
+// (i.e. whenever we're not running under a systemd unit), which is how
+// daemon.SdNotify itself behaves -- nothing extra to guard here.
+
+func sdNotifyReady() {
+	daemon.SdNotify(false, daemon.SdNotifyReady)
+}
+
+func sdNotifyStopping() {
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+}
+
+// sdWatchdogLoop sends WATCHDOG=1 at half of WATCHDOG_USEC (as required by
+// sd_watchdog_enabled(3)) for as long as healthy() returns true, and pushes
+// a STATUS= line from status() on the same tick. It returns immediately,
+// without blocking, if the unit wasn't started with a watchdog interval.
+func sdWatchdogLoop(healthy func() bool, status func() string, stop <-chan struct{}) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if healthy() {
+				daemon.SdNotify(false, daemon.SdNotifyWatchdog)
+			}
+			daemon.SdNotify(false, daemon.SdNotifyStatus+status())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	flapjack "github.com/flapjack/flapjack/src/flapjack"
+
+	"github.com/sol1/flapjack-icinga2/events"
+)
+
+// entityCheck derives the Flapjack (entity, check) pair from an event's
+// host/service -- "HOST" is Flapjack's convention for host-only checks.
+func entityCheck(host, service string) (entity, check string) {
+	if service == "" {
+		return host, "HOST"
+	}
+	return host, service
+}
+
+// https://github.com/Icinga/icinga2/blob/master/lib/icinga/checkresult.ti#L37-L48
+func stateName(state float64) (string, error) {
+	switch state {
+	case 0.0:
+		return "ok", nil
+	case 1.0:
+		return "warning", nil
+	case 2.0:
+		return "critical", nil
+	case 3.0:
+		return "unknown", nil
+	default:
+		return "", fmt.Errorf("Unknown state %.1f", state)
+	}
+}
+
+// checkResultToEvent fetches the host/service's vars (for tags) and builds
+// the Flapjack event for a CheckResult/StateChange stream event.
+func (ac *ApiClient) checkResultToEvent(e events.CheckResultEvent) (*flapjack.Event, error) {
+	state, err := stateName(e.CheckResult.State)
+	if err != nil {
+		return nil, err
+	}
+
+	entity, check := entityCheck(e.Host, e.Service)
+
+	tags, err := ac.fetchTags(e.Host, e.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flapjack.Event{
+		Entity:  entity,
+		Check:   check,
+		Type:    "service",
+		Time:    int64(e.Timestamp),
+		State:   state,
+		Summary: e.CheckResult.Output,
+		Details: fmt.Sprintf("tags: %s", tags),
+		Tags:    tags,
+	}, nil
+}
+
+// fetchTags follows up with a GET against the host/service's own API object
+// to pick up its `vars.tags`, which the event stream payload doesn't carry.
+func (ac *ApiClient) fetchTags(host, service string) ([]string, error) {
+	serviceType := "hosts"
+	name := host
+	if service != "" {
+		serviceType = "services"
+		name = fmt.Sprintf("%s!%s", host, service)
+	}
+
+	varURL := ac.icingaURL(fmt.Sprintf("/v1/objects/%s/%s", serviceType, name))
+
+	client := ac.NewHttpClient()
+	req := ac.NewHttpRequest("GET", varURL)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parsed events.ObjectsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+	if len(parsed.Results) == 0 {
+		return nil, fmt.Errorf("no such object: %s", name)
+	}
+
+	return parsed.Results[0].Attrs.Vars.Tags, nil
+}
+
+// commentToEvent translates a CommentAdded/CommentRemoved event into an
+// informational Flapjack action event.
+func commentToEvent(e events.CommentEvent) *flapjack.Event {
+	entity, check := entityCheck(e.Host, e.Service)
+
+	state := "comment_added"
+	if e.Type == "CommentRemoved" {
+		state = "comment_removed"
+	}
+
+	return &flapjack.Event{
+		Entity:  entity,
+		Check:   check,
+		Type:    "action",
+		Time:    int64(e.Timestamp),
+		State:   state,
+		Summary: e.Comment.Text,
+		Details: fmt.Sprintf("author: %s", e.Comment.Author),
+	}
+}
+
+// acknowledgementToEvent translates an AcknowledgementSet/Cleared event into
+// a Flapjack action event carrying the acknowledging author, comment and
+// expiry.
+func acknowledgementToEvent(e events.AcknowledgementEvent) *flapjack.Event {
+	entity, check := entityCheck(e.Host, e.Service)
+
+	state := "acknowledgement"
+	summary := e.Comment
+	if e.Type == "AcknowledgementCleared" {
+		state = "acknowledgement_cleared"
+		summary = ""
+	}
+
+	return &flapjack.Event{
+		Entity:  entity,
+		Check:   check,
+		Type:    "action",
+		Time:    int64(e.Timestamp),
+		State:   state,
+		Summary: summary,
+		Details: fmt.Sprintf("author: %s, expiry: %.0f", e.Author, e.Expiry),
+	}
+}
+
+// downtimeToEvent records a Downtime{Added,Removed,Started,Triggered} event
+// as a real scheduled-maintenance window in Redis -- a per-check
+// "<entity>:<check>:scheduled_maintenances" sorted set, the same
+// representation Flapjack itself reads downtime windows from -- and returns
+// an informational action event for the stream log. When ac.batchRedis is
+// nil, no window is recorded and only the action event is returned.
+func (ac *ApiClient) downtimeToEvent(e events.DowntimeEvent) (*flapjack.Event, error) {
+	entity, check := entityCheck(e.Host, e.Service)
+
+	if ac.batchRedis != nil {
+		var err error
+		switch e.Type {
+		case "DowntimeAdded", "DowntimeStarted", "DowntimeTriggered":
+			err = ac.batchRedis.PushScheduledMaintenance(entity, check, scheduledMaintenance{
+				StartTime: e.Downtime.StartTime,
+				Duration:  e.Downtime.Duration,
+				Summary:   e.Downtime.Comment,
+			})
+		case "DowntimeRemoved":
+			err = ac.batchRedis.RemoveScheduledMaintenance(entity, check, e.Downtime.StartTime)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("recording scheduled maintenance for %s!%s: %s", entity, check, err)
+		}
+	}
+
+	state := "scheduled_maintenance"
+	if e.Type == "DowntimeRemoved" {
+		state = "scheduled_maintenance_cancelled"
+	}
+
+	return &flapjack.Event{
+		Entity:  entity,
+		Check:   check,
+		Type:    "action",
+		Time:    int64(e.Timestamp),
+		State:   state,
+		Summary: e.Downtime.Comment,
+		Details: fmt.Sprintf("author: %s, start_time: %.0f, duration: %.0f", e.Downtime.Author, e.Downtime.StartTime, e.Downtime.Duration),
+	}, nil
+}